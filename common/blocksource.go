@@ -0,0 +1,190 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/adityapk00/lightwalletd/parser"
+	"github.com/adityapk00/lightwalletd/walletrpc"
+	"github.com/sirupsen/logrus"
+)
+
+// BlockEvent is emitted by a BlockSource whenever it observes a new best
+// block on the network. It carries no payload beyond the notification
+// itself; BlockIngestor always re-derives height/hash from chain state.
+type BlockEvent struct{}
+
+// BlockSource abstracts how lightwalletd learns about and retrieves blocks
+// from zcashd, so BlockIngestor isn't hard-coded to RPC polling.
+// Implementations: rpcBlockSource (always available) and zmqBlockSource
+// (push-based, used when Options.ZMQEndpoint is set).
+type BlockSource interface {
+	// BestBlockHash returns the hash of the current chain tip.
+	BestBlockHash() ([]byte, error)
+
+	// GetBlock returns the compact block at the given height, or nil if
+	// zcashd doesn't have a block at that height yet.
+	GetBlock(height int) (*walletrpc.CompactBlock, error)
+
+	// Subscribe returns a channel that receives a BlockEvent whenever the
+	// source observes a new tip, closed when ctx is done. A source with no
+	// push mechanism (rpcBlockSource) returns nil; BlockIngestor then falls
+	// back to polling on a fixed interval.
+	Subscribe(ctx context.Context) <-chan BlockEvent
+}
+
+// rpcBlockSource is the original zcashd JSON-RPC client, reachable via the
+// package-level RawRequest hook. It has no push mechanism of its own.
+type rpcBlockSource struct{}
+
+// NewRPCBlockSource returns a BlockSource backed by zcashd's JSON-RPC
+// interface (getbestblockhash/getblock).
+func NewRPCBlockSource() BlockSource {
+	return &rpcBlockSource{}
+}
+
+func (s *rpcBlockSource) BestBlockHash() ([]byte, error) {
+	return getBestBlockHash()
+}
+
+func (s *rpcBlockSource) GetBlock(height int) (*walletrpc.CompactBlock, error) {
+	return getBlockFromRPC(height)
+}
+
+func (s *rpcBlockSource) Subscribe(ctx context.Context) <-chan BlockEvent {
+	return nil
+}
+
+// NewBlockSource returns the push-based ZMQ source when endpoint is
+// non-empty, otherwise the plain RPC-polling source.
+func NewBlockSource(endpoint string) BlockSource {
+	if endpoint == "" {
+		return NewRPCBlockSource()
+	}
+	return NewZMQBlockSource(endpoint)
+}
+
+// pollIdleTimeout bounds how long BlockIngestor waits for a push
+// notification before falling back to polling BestBlockHash directly, so a
+// dropped ZMQ connection degrades to the old polling behavior rather than
+// stalling ingestion.
+const pollIdleTimeout = 5 * time.Second
+
+// BlockIngestor runs as a goroutine and ingests new blocks into the cache,
+// using Options.ZMQEndpoint (set via SetZMQEndpoint at startup) to pick a
+// push-based or RPC-polling BlockSource. The repetition count, rep, is
+// nonzero only for unit-testing.
+//
+// It first runs the concurrent pipelineCatchUp fetcher to race through any
+// backlog (e.g. initial sync), then falls back to the single-block,
+// push-aware loop for steady-state tip-following.
+func BlockIngestor(c *BlockCache, rep int) {
+	source := NewBlockSource(zmqEndpoint)
+	if rep == 0 {
+		pipelineCatchUp(c, source)
+	}
+	ingestFromSource(c, source, rep)
+}
+
+// ingestFromSource is the thin event loop shared by every BlockSource: it
+// waits for a push notification (or the poll timeout), fetches the next
+// block, and still handles reorgs via c.HashMatch/c.Reorg exactly as
+// before. Split out from BlockIngestor so tests can inject a fake source.
+func ingestFromSource(c *BlockCache, source BlockSource, rep int) {
+	lastLog := Time.Now()
+	lastHeightLogged := 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := source.Subscribe(ctx)
+
+	for i := 0; rep == 0 || i < rep; i++ {
+		select {
+		case <-stopIngestorChan:
+			return
+		default:
+		}
+
+		waitForTip(events)
+
+		lastBestBlockHash, err := source.BestBlockHash()
+		if err != nil {
+			Log.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("error getting best block hash")
+		}
+
+		height := c.GetNextHeight()
+		if string(lastBestBlockHash) == string(parser.Reverse(c.GetLatestHash())) {
+			// Synced
+			c.Sync()
+			if lastHeightLogged != height-1 {
+				lastHeightLogged = height - 1
+				Log.Info("Waiting for block: ", height)
+			}
+			Time.Sleep(2 * time.Second)
+			lastLog = Time.Now()
+			continue
+		}
+		block, err := source.GetBlock(height)
+		if err != nil {
+			Log.Fatal("getblock failed, will retry", err)
+		}
+		if block != nil && c.HashMatch(block.PrevHash) {
+			if err = c.Add(height, block); err != nil {
+				Log.Fatal("Cache add failed:", err)
+			}
+			persistIngested(height, block)
+			// Don't log these too often.
+			if DarksideEnabled || Time.Now().Sub(lastLog).Seconds() >= 4 {
+				lastLog = Time.Now()
+				Log.Info("Adding block to cache ", height, " ", displayHash(block.Hash))
+			}
+			continue
+		}
+		if height == c.GetFirstHeight() {
+			c.Sync()
+			Log.Info("Waiting for zcashd height to reach Sapling activation height ",
+				"(", c.GetFirstHeight(), ")...")
+			Time.Sleep(20 * time.Second)
+			return
+		}
+		Log.Info("REORG: dropping block ", height-1, " ", displayHash(c.GetLatestHash()))
+		c.Reorg(height - 1)
+		persistReorg(height - 1)
+	}
+}
+
+// waitForTip blocks until either a push notification arrives on events or
+// pollIdleTimeout elapses, whichever comes first. A nil events channel (no
+// push source configured) returns immediately, preserving the old fixed
+// polling cadence driven by the caller's own Time.Sleep calls.
+func waitForTip(events <-chan BlockEvent) {
+	if events == nil {
+		return
+	}
+	select {
+	case _, ok := <-events:
+		if !ok {
+			return
+		}
+	case <-time.After(pollIdleTimeout):
+	}
+}
+
+// zmqEndpoint is set by the server's startup code from Options.ZMQEndpoint
+// via SetZMQEndpoint. It's a package variable (like RawRequest and Time) so
+// unit tests can exercise BlockIngestor without the rest of server setup.
+var zmqEndpoint string
+
+// SetZMQEndpoint configures the ZMQ endpoint BlockIngestor subscribes to
+// for zcashd's hashblock/rawblock topics. Called once at startup from
+// Options.ZMQEndpoint; an empty endpoint disables push ingestion and
+// BlockIngestor falls back to pure RPC polling.
+func SetZMQEndpoint(endpoint string) {
+	zmqEndpoint = endpoint
+}
@@ -15,7 +15,6 @@ import (
 	"github.com/adityapk00/lightwalletd/walletrpc"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"google.golang.org/protobuf/proto"
 )
 
 // 'make build' will overwrite this string with the output of git-describe (tag)
@@ -48,6 +47,10 @@ type Options struct {
 	PingEnable          bool   `json:"ping_enable"`
 	Darkside            bool   `json:"darkside"`
 	DarksideTimeout     uint64 `json:"darkside_timeout"`
+	ZMQEndpoint         string `json:"zmq_endpoint,omitempty"`
+	IngestConcurrency   int    `json:"ingest_concurrency,omitempty"`
+	IngestBatch         int    `json:"ingest_batch,omitempty"`
+	SpamFilterConfig    string `json:"spam_filter_config,omitempty"`
 }
 
 // RawRequest points to the function to send a an RPC request to zcashd;
@@ -332,9 +335,29 @@ var (
 	stopIngestorChan = make(chan struct{})
 )
 
-func startIngestor(c *BlockCache) {
+// startIngestor is the integration point the server's startup code calls
+// once it has parsed Options: it wires the relevant fields (ZMQEndpoint,
+// IngestConcurrency/IngestBatch, DataDir, SpamFilterConfig) into the
+// package-level settings BlockIngestor and FilterSpammyBlock read, then
+// starts the ingestor goroutine.
+func startIngestor(c *BlockCache, o *Options) {
 	if !ingestorRunning {
 		ingestorRunning = true
+		SetZMQEndpoint(o.ZMQEndpoint)
+		SetIngestOptions(o.IngestConcurrency, o.IngestBatch)
+		if _, err := InitDiskStore(o.DataDir); err != nil {
+			Log.Fatal("error opening on-disk block store:", err)
+		}
+		if o.SpamFilterConfig != "" {
+			sf, err := LoadSpamFilterConfig(o.SpamFilterConfig)
+			if err != nil {
+				Log.Fatal("error loading spam filter config:", err)
+			}
+			SetSpamFilter(sf)
+		}
+		if o.ZMQEndpoint != "" {
+			StartMempoolMonitor(o.ZMQEndpoint)
+		}
 		go BlockIngestor(c, 0)
 	}
 }
@@ -342,92 +365,41 @@ func stopIngestor() {
 	if ingestorRunning {
 		ingestorRunning = false
 		stopIngestorChan <- struct{}{}
+		StopDiskStore()
+		StopMempoolMonitor()
 	}
 }
 
-// BlockIngestor runs as a goroutine and polls zcashd for new blocks, adding them
-// to the cache. The repetition count, rep, is nonzero only for unit-testing.
-func BlockIngestor(c *BlockCache, rep int) {
-	lastLog := Time.Now()
-	lastHeightLogged := 0
-
-	// Start listening for new blocks
-	for i := 0; rep == 0 || i < rep; i++ {
-		// stop if requested
-		select {
-		case <-stopIngestorChan:
-			return
-		default:
-		}
-
-		result, err := RawRequest("getbestblockhash", []json.RawMessage{})
-		if err != nil {
-			Log.WithFields(logrus.Fields{
-				"error": err,
-			}).Fatal("error zcashd getbestblockhash rpc")
-		}
-		var hashHex string
-		err = json.Unmarshal(result, &hashHex)
-		if err != nil {
-			Log.Fatal("bad getbestblockhash return:", err, result)
-		}
-		lastBestBlockHash := []byte{}
-		lastBestBlockHash, err = hex.DecodeString(hashHex)
-		if err != nil {
-			Log.Fatal("error decoding getbestblockhash", err, hashHex)
-		}
-
-		height := c.GetNextHeight()
-		if string(lastBestBlockHash) == string(parser.Reverse(c.GetLatestHash())) {
-			// Synced
-			c.Sync()
-			if lastHeightLogged != height-1 {
-				lastHeightLogged = height - 1
-				Log.Info("Waiting for block: ", height)
-			}
-			Time.Sleep(2 * time.Second)
-			lastLog = Time.Now()
-			continue
-		}
-		var block *walletrpc.CompactBlock
-		block, err = getBlockFromRPC(height)
-		if err != nil {
-			Log.Fatal("getblock failed, will retry", err)
-		}
-		if block != nil && c.HashMatch(block.PrevHash) {
-			if err = c.Add(height, block); err != nil {
-				Log.Fatal("Cache add failed:", err)
-			}
-			// Don't log these too often.
-			if DarksideEnabled || Time.Now().Sub(lastLog).Seconds() >= 4 {
-				lastLog = Time.Now()
-				Log.Info("Adding block to cache ", height, " ", displayHash(block.Hash))
-			}
-			continue
-		}
-		if height == c.GetFirstHeight() {
-			c.Sync()
-			Log.Info("Waiting for zcashd height to reach Sapling activation height ",
-				"(", c.GetFirstHeight(), ")...")
-			Time.Sleep(20 * time.Second)
-			return
-		}
-		Log.Info("REORG: dropping block ", height-1, " ", displayHash(c.GetLatestHash()))
-		c.Reorg(height - 1)
-	}
-}
+// BlockIngestor itself now lives in blocksource.go: it's a thin loop over a
+// BlockSource (RPC-polling or ZMQ push) rather than hard-coded to RawRequest
+// polling. getBestBlockHash and getBlockFromRPC below remain the backing
+// implementation for the RPC source.
 
-// GetBlock returns the compact block at the requested height, first by querying
-// the cache, then, if not found, will request the block from zcashd. It returns
-// nil if no block exists at this height.
+// GetBlock returns the compact block at the requested height, first by
+// querying the in-process cache, then the on-disk store (if configured via
+// InitDiskStore), and only then falling back to zcashd. It returns nil if
+// no block exists at this height.
 func GetBlock(cache *BlockCache, height int) (*walletrpc.CompactBlock, error) {
 	// First, check the cache to see if we have the block
 	block := cache.Get(height)
 	if block != nil {
+		if Metrics != nil {
+			Metrics.cacheHitCounter.Inc()
+		}
 		return block, nil
 	}
 
-	// Not in the cache, ask zcashd
+	// Not in the in-process cache; check the durable on-disk store.
+	if diskStore != nil {
+		block, err := diskStore.Get(height)
+		if err != nil {
+			Log.WithFields(logrus.Fields{"error": err, "height": height}).Warn("diskStore.Get failed")
+		} else if block != nil {
+			return block, nil
+		}
+	}
+
+	// Not cached anywhere, ask zcashd
 	block, err := getBlockFromRPC(height)
 	if err != nil {
 		return nil, err
@@ -439,34 +411,30 @@ func GetBlock(cache *BlockCache, height int) (*walletrpc.CompactBlock, error) {
 	return block, nil
 }
 
-// Filters out blocks that have spammy transactions
+// spamFilter is the rules-based policy engine configured via
+// Options.SpamFilterConfig (see SetSpamFilter). When nil, FilterSpammyBlock
+// falls back to the original outputs+actions>threshold heuristic.
+var spamFilter *SpamFilter
+
+// SetSpamFilter installs the rules-based spam filter loaded from
+// Options.SpamFilterConfig. Called once at startup; a nil argument (no
+// config configured) restores the legacy single-heuristic behavior.
+func SetSpamFilter(sf *SpamFilter) {
+	spamFilter = sf
+}
+
+// FilterSpammyBlock filters out spammy transactions from a block, either
+// via the configured rules-based SpamFilter (see spamfilter.go) or,
+// absent one, the legacy outputs+actions>threshold heuristic. A threshold
+// of 0 means "don't filter", same as before this was made configurable.
 func FilterSpammyBlock(block *walletrpc.CompactBlock, spamFilterThreshold int) *walletrpc.CompactBlock {
 	if spamFilterThreshold == 0 {
 		return block
 	}
-
-	// Make a copy of the block so we can modify it
-	newBlock := proto.Clone(block).(*walletrpc.CompactBlock)
-
-	// Filter out Sapling transactions above the threshold by removing epk and ciphertext
-	for _, tx := range newBlock.Vtx {
-		if len(tx.Outputs)+len(tx.Actions) > spamFilterThreshold {
-			// Remove epk and ciphertext for Sapling Outputs
-			for _, outputs := range tx.Outputs {
-				outputs.Ciphertext = nil
-				outputs.Epk = nil
-			}
-
-			// Remove epk and ciphertext and nullifier for Actions
-			for _, action := range tx.Actions {
-				action.Ciphertext = nil
-				action.EphemeralKey = nil
-				action.Nullifier = nil
-			}
-		}
+	if spamFilter != nil {
+		return spamFilter.Apply(block, spamFilterThreshold)
 	}
-
-	return newBlock
+	return legacyFilterSpammyBlock(block, spamFilterThreshold)
 }
 
 // GetBlockRange returns a sequence of consecutive blocks in the given range.
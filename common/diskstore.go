@@ -0,0 +1,591 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adityapk00/lightwalletd/walletrpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/proto"
+)
+
+// DiskStore is a durable, append-only backing store for BlockCache: it lets
+// lightwalletd serve historical block ranges without re-hitting zcashd
+// after a restart. Blocks are appended as length-prefixed CompactBlock
+// protos to segment files under Options.DataDir/blocks, and a parallel
+// mmap'd fixed-width index maps height -> (segment, offset, length, hash)
+// so Get is an O(1) mmap lookup rather than a linear scan.
+//
+// DiskStore is safe for concurrent Get calls but assumes a single writer
+// (the block ingestor), matching BlockCache's existing concurrency model.
+type DiskStore struct {
+	dir string
+
+	mu           sync.RWMutex
+	index        *diskIndex
+	segments     map[uint32]*os.File // open for append; current + recently touched
+	curSegment   uint32
+	curSegOffset int64
+
+	hits, misses uint64 // served from mmap index vs required an RPC fallback
+}
+
+const (
+	// diskSegmentMaxBytes bounds how large a single segment file grows
+	// before a new one is started, so the compactor can reclaim dead space
+	// segment-at-a-time instead of rewriting one huge file.
+	diskSegmentMaxBytes = 256 << 20 // 256MiB
+
+	// diskIndexEntrySize is the fixed width of one index record:
+	// height(4) + segment(4) + offset(8) + length(4) + hash(32).
+	diskIndexEntrySize = 4 + 4 + 8 + 4 + 32
+
+	// compactDeadRatioThreshold triggers the background compactor: once
+	// this fraction of a segment's bytes belong to superseded (reorged)
+	// blocks, it's rewritten without them.
+	compactDeadRatioThreshold = 0.5
+
+	// diskIndexTombstoneSegment marks an index record as a tombstone (the
+	// height it names was dropped by Reorg) rather than a live entry.
+	// Real segment numbers are allocated starting at 0, so this value
+	// never collides with one.
+	diskIndexTombstoneSegment = ^uint32(0)
+)
+
+// diskIndexEntry is the on-disk (and mmap'd) representation of one index
+// record. Field order matches diskIndexEntrySize's layout exactly.
+type diskIndexEntry struct {
+	Segment uint32
+	Offset  uint64
+	Length  uint32
+	Hash    [32]byte
+}
+
+// diskIndex is the mmap'd height -> entry index. It's rebuilt/validated
+// from the tail of the latest segment on startup, since the last write
+// before a crash may not have updated the index.
+type diskIndex struct {
+	mu      sync.RWMutex
+	mapping []byte // mmap'd backing file, grown (remapped) as needed
+	entries map[int]diskIndexEntry
+	path    string
+}
+
+// diskStore is the package-level DiskStore wired in by InitDiskStore at
+// startup (mirrors the zmqEndpoint/spamFilter package-variable pattern). A
+// nil diskStore means cold reads always fall through to zcashd RPC, same
+// as before this feature existed.
+var diskStore *DiskStore
+
+// InitDiskStore opens the on-disk block store rooted at dataDir and
+// installs it as the package-level diskStore that GetBlock, the ingestor,
+// and Reorg consult. Called once at startup from Options.DataDir; an empty
+// dataDir leaves diskStore nil (feature disabled).
+func InitDiskStore(dataDir string) (*DiskStore, error) {
+	if dataDir == "" {
+		return nil, nil
+	}
+	ds, err := NewDiskStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	diskStore = ds
+	go ds.runCompactor(compactInterval, diskStoreStopChan)
+	return ds, nil
+}
+
+// compactInterval is how often the background compactor checks segments
+// for their dead-byte ratio.
+const compactInterval = 10 * time.Minute
+
+// diskStoreStopChan is closed by StopDiskStore to shut down the background
+// compactor. It's a distinct channel from stopIngestorChan (which is sent
+// to, not closed, and has exactly one reader) since the compactor and the
+// ingestor have independent lifecycles.
+var diskStoreStopChan = make(chan struct{})
+
+// StopDiskStore shuts down the background compactor started by
+// InitDiskStore. Safe to call even if InitDiskStore was never called.
+func StopDiskStore() {
+	select {
+	case <-diskStoreStopChan:
+		// already stopped
+	default:
+		close(diskStoreStopChan)
+	}
+}
+
+// runCompactor periodically calls Compact until stop is closed.
+func (ds *DiskStore) runCompactor(interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if err := ds.Compact(); err != nil {
+			Log.WithFields(logrus.Fields{"error": err}).Warn("diskStore.Compact failed")
+		}
+	}
+}
+
+// persistIngested writes a newly-ingested block through to the on-disk
+// store, if one is configured. Called by the ingestor right after a block
+// is accepted into BlockCache, so cold reads after a restart don't need
+// zcashd at all for anything BlockCache has already evicted.
+func persistIngested(height int, block *walletrpc.CompactBlock) {
+	if diskStore == nil {
+		return
+	}
+	if err := diskStore.Put(height, block); err != nil {
+		Log.WithFields(logrus.Fields{"error": err, "height": height}).Warn("diskStore.Put failed")
+	}
+}
+
+// persistReorg truncates the on-disk store's index at height, if one is
+// configured, mirroring BlockCache.Reorg.
+func persistReorg(height int) {
+	if diskStore == nil {
+		return
+	}
+	if err := diskStore.Reorg(height); err != nil {
+		Log.WithFields(logrus.Fields{"error": err, "height": height}).Warn("diskStore.Reorg failed")
+	}
+}
+
+// NewDiskStore opens (creating if necessary) the on-disk block store rooted
+// at dataDir. It rebuilds/validates the index tail by scanning the last
+// segment, so that a crash between a block append and its index write
+// can't leave the index pointing past the end of a file.
+func NewDiskStore(dataDir string) (*DiskStore, error) {
+	dir := filepath.Join(dataDir, "blocks")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating block store directory")
+	}
+	idx, err := openDiskIndex(filepath.Join(dir, "index"))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening block index")
+	}
+	ds := &DiskStore{
+		dir:      dir,
+		index:    idx,
+		segments: make(map[uint32]*os.File),
+	}
+	if err := ds.openCurrentSegment(); err != nil {
+		return nil, err
+	}
+	if err := ds.rebuildTail(); err != nil {
+		return nil, errors.Wrap(err, "rebuilding index tail")
+	}
+	return ds, nil
+}
+
+func openDiskIndex(path string) (*diskIndex, error) {
+	idx := &diskIndex{path: path, entries: make(map[int]diskIndexEntry)}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return idx, nil
+	}
+	mapping, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap index")
+	}
+	idx.mapping = mapping
+	for off := 0; off+diskIndexEntrySize <= len(mapping); off += diskIndexEntrySize {
+		rec := mapping[off : off+diskIndexEntrySize]
+		height := int(int32(binary.LittleEndian.Uint32(rec[0:4])))
+		var e diskIndexEntry
+		e.Segment = binary.LittleEndian.Uint32(rec[4:8])
+		e.Offset = binary.LittleEndian.Uint64(rec[8:16])
+		e.Length = binary.LittleEndian.Uint32(rec[16:20])
+		copy(e.Hash[:], rec[20:52])
+		if e.Segment == diskIndexTombstoneSegment {
+			delete(idx.entries, height)
+			continue
+		}
+		idx.entries[height] = e
+	}
+	return idx, nil
+}
+
+// writeRecordLocked appends one index record (height, e) to the on-disk
+// index file. The caller must hold idx.mu and is responsible for keeping
+// idx.entries consistent with what's written; writeRecordLocked itself
+// only ever appends (truncation and rewritten offsets are both recorded
+// as new records, same as the in-memory map's last-write-wins semantics
+// on reload, see openDiskIndex).
+func (idx *diskIndex) writeRecordLocked(height int, e diskIndexEntry) error {
+	f, err := os.OpenFile(idx.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rec := make([]byte, diskIndexEntrySize)
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(int32(height)))
+	binary.LittleEndian.PutUint32(rec[4:8], e.Segment)
+	binary.LittleEndian.PutUint64(rec[8:16], e.Offset)
+	binary.LittleEndian.PutUint32(rec[16:20], e.Length)
+	copy(rec[20:52], e.Hash[:])
+	_, err = f.Write(rec)
+	return err
+}
+
+// append writes one index record for height, both to the in-memory map
+// (used for lookups) and to the end of the on-disk index file.
+func (idx *diskIndex) append(height int, e diskIndexEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err := idx.writeRecordLocked(height, e); err != nil {
+		return err
+	}
+	idx.entries[height] = e
+	return nil
+}
+
+// truncate drops every index entry at or above height, marking the
+// corresponding segment bytes dead (reclaimed later by the compactor)
+// rather than rewriting segment files synchronously during a reorg. Each
+// dropped height is also recorded as a tombstone in the on-disk index,
+// so a restart after a reorg doesn't resurrect the now-superseded entry
+// from the file's earlier (live) record for that height.
+func (idx *diskIndex) truncate(height int) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for h := range idx.entries {
+		if h < height {
+			continue
+		}
+		if err := idx.writeRecordLocked(h, diskIndexEntry{Segment: diskIndexTombstoneSegment}); err != nil {
+			return err
+		}
+		delete(idx.entries, h)
+	}
+	return nil
+}
+
+func (idx *diskIndex) get(height int) (diskIndexEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	e, ok := idx.entries[height]
+	return e, ok
+}
+
+func (ds *DiskStore) openCurrentSegment() error {
+	matches, err := filepath.Glob(filepath.Join(ds.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	var maxSeg uint32
+	for _, m := range matches {
+		var n uint32
+		if _, err := fmt.Sscanf(filepath.Base(m), "%08d.seg", &n); err == nil && n > maxSeg {
+			maxSeg = n
+		}
+	}
+	return ds.openSegmentForAppend(maxSeg)
+}
+
+func (ds *DiskStore) segmentPath(seg uint32) string {
+	return filepath.Join(ds.dir, fmt.Sprintf("%08d.seg", seg))
+}
+
+func (ds *DiskStore) openSegmentForAppend(seg uint32) error {
+	f, err := os.OpenFile(ds.segmentPath(seg), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening segment")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// Close and evict the previous append target: once we rotate away from
+	// it, the compactor is free to rewrite it (and rename a new file over
+	// its path), and a long-lived fd cached here would keep reading the
+	// pre-compaction inode against post-compaction offsets. Get() always
+	// opens a fresh fd for reads, so the only thing ds.segments needs to
+	// hold is the file currently being appended to.
+	if old, ok := ds.segments[ds.curSegment]; ok && ds.curSegment != seg {
+		old.Close()
+		delete(ds.segments, ds.curSegment)
+	}
+	ds.segments[seg] = f
+	ds.curSegment = seg
+	ds.curSegOffset = info.Size()
+	return nil
+}
+
+// Put appends block at height to the current segment and records it in
+// the index. Called by BlockCache.Add once a block is accepted.
+func (ds *DiskStore) Put(height int, block *walletrpc.CompactBlock) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	data, err := proto.Marshal(block)
+	if err != nil {
+		return errors.Wrap(err, "marshaling compact block")
+	}
+	if ds.curSegOffset >= diskSegmentMaxBytes {
+		if err := ds.openSegmentForAppend(ds.curSegment + 1); err != nil {
+			return err
+		}
+	}
+	f := ds.segments[ds.curSegment]
+	w := bufio.NewWriter(f)
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	var hash [32]byte
+	copy(hash[:], block.Hash)
+	entry := diskIndexEntry{
+		Segment: ds.curSegment,
+		Offset:  uint64(ds.curSegOffset),
+		Length:  uint32(4 + len(data)),
+		Hash:    hash,
+	}
+	ds.curSegOffset += int64(entry.Length)
+	return ds.index.append(height, entry)
+}
+
+// Get returns the compact block at height from disk, or nil if it's not
+// present in the store (the caller then falls back to RPC). Served from
+// the mmap'd index plus one pread, no scanning.
+//
+// Get always opens its own read-only fd rather than reusing a cached
+// handle from ds.segments: that map only tracks the segment currently
+// open for append, and a long-lived fd on a segment that's since been
+// rewritten by the compactor (which renames a new file over the old path)
+// would keep reading the old inode's bytes at the new file's offsets.
+func (ds *DiskStore) Get(height int) (*walletrpc.CompactBlock, error) {
+	entry, ok := ds.index.get(height)
+	if !ok {
+		ds.mu.Lock()
+		ds.misses++
+		ds.mu.Unlock()
+		if Metrics != nil {
+			Metrics.cacheFallbackCounter.Inc()
+		}
+		return nil, nil
+	}
+
+	f, err := os.Open(ds.segmentPath(entry.Segment))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening segment for read")
+	}
+	defer f.Close()
+
+	// compactSegment renames its rewritten segment into place before
+	// persisting the moved entries' new offsets to the on-disk index (see
+	// compactSegment), so a crash in between can leave an index record
+	// whose offset predates compaction pointing past the end of the
+	// now-smaller file. Treat that the same as an index miss rather than
+	// surfacing a read error: the caller falls back to RPC, and the next
+	// compaction pass (or a Put at this height again) repairs the record.
+	if info, err := f.Stat(); err == nil && int64(entry.Offset)+int64(entry.Length) > info.Size() {
+		ds.mu.Lock()
+		ds.misses++
+		ds.mu.Unlock()
+		if Metrics != nil {
+			Metrics.cacheFallbackCounter.Inc()
+		}
+		return nil, nil
+	}
+
+	buf := make([]byte, entry.Length)
+	if _, err := f.ReadAt(buf, int64(entry.Offset)); err != nil {
+		return nil, errors.Wrap(err, "reading segment")
+	}
+	dataLen := binary.LittleEndian.Uint32(buf[0:4])
+	var block walletrpc.CompactBlock
+	if err := proto.Unmarshal(buf[4:4+dataLen], &block); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling compact block")
+	}
+
+	ds.mu.Lock()
+	ds.hits++
+	ds.mu.Unlock()
+	if Metrics != nil {
+		Metrics.cacheDiskHitCounter.Inc()
+	}
+	return &block, nil
+}
+
+// Reorg truncates the index at height and marks the now-dead segment bytes
+// for later reclamation; it does not rewrite segment files inline so a
+// reorg stays cheap, matching BlockCache.Reorg's existing O(1) behavior.
+// The truncation is recorded on disk (see diskIndex.truncate) so a restart
+// after a reorg doesn't resurrect the superseded blocks.
+func (ds *DiskStore) Reorg(height int) error {
+	return ds.index.truncate(height)
+}
+
+// rebuildTail re-validates the index entries that reference the current
+// (last) segment, in case the process crashed after appending a block but
+// before its index record was durable. Any index entry whose recorded
+// offset+length exceeds the segment's actual size is dropped.
+func (ds *DiskStore) rebuildTail() error {
+	ds.mu.RLock()
+	f := ds.segments[ds.curSegment]
+	seg := ds.curSegment
+	ds.mu.RUnlock()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	ds.index.mu.Lock()
+	defer ds.index.mu.Unlock()
+	for h, e := range ds.index.entries {
+		if e.Segment == seg && int64(e.Offset+uint64(e.Length)) > size {
+			delete(ds.index.entries, h)
+		}
+	}
+	return nil
+}
+
+// Compact rewrites any segment whose dead-byte ratio exceeds
+// compactDeadRatioThreshold into a fresh segment containing only live
+// blocks, then updates the index to point at the new locations. Intended
+// to run periodically from a background goroutine started alongside
+// BlockIngestor.
+func (ds *DiskStore) Compact() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	deadBytes := make(map[uint32]int64)
+	liveBytes := make(map[uint32]int64)
+	ds.index.mu.RLock()
+	for _, e := range ds.index.entries {
+		liveBytes[e.Segment] += int64(e.Length)
+	}
+	ds.index.mu.RUnlock()
+
+	matches, err := filepath.Glob(filepath.Join(ds.dir, "*.seg"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		var seg uint32
+		if _, err := fmt.Sscanf(filepath.Base(m), "%08d.seg", &seg); err != nil {
+			continue
+		}
+		if seg == ds.curSegment {
+			continue // never compact the segment still being appended to
+		}
+		info, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		deadBytes[seg] = info.Size() - liveBytes[seg]
+		if info.Size() == 0 {
+			continue
+		}
+		if float64(deadBytes[seg])/float64(info.Size()) > compactDeadRatioThreshold {
+			if err := ds.compactSegment(seg); err != nil {
+				return errors.Wrapf(err, "compacting segment %d", seg)
+			}
+		}
+	}
+	return nil
+}
+
+// compactSegment rewrites seg's live blocks into a new file, remaps their
+// index entries to the new offsets, then replaces the original.
+func (ds *DiskStore) compactSegment(seg uint32) error {
+	old, err := os.Open(ds.segmentPath(seg))
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	tmpPath := ds.segmentPath(seg) + ".compact"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+
+	ds.index.mu.Lock()
+	defer ds.index.mu.Unlock()
+
+	var newOffset int64
+	var moved []int // heights whose on-disk offset needs to be re-recorded
+	for h, e := range ds.index.entries {
+		if e.Segment != seg {
+			continue
+		}
+		buf := make([]byte, e.Length)
+		if _, err := old.ReadAt(buf, int64(e.Offset)); err != nil {
+			return err
+		}
+		if _, err := tmp.Write(buf); err != nil {
+			return err
+		}
+		e.Offset = uint64(newOffset)
+		newOffset += int64(e.Length)
+		ds.index.entries[h] = e
+		moved = append(moved, h)
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	// Defensive: seg should never be ds.curSegment here (the caller skips
+	// it), so ds.segments should already have no entry for it, but close
+	// out any cached fd before the rename repoints the path out from under
+	// it. compactSegment is only ever called with ds.mu already held by
+	// Compact, so no separate locking here.
+	if f, ok := ds.segments[seg]; ok {
+		f.Close()
+		delete(ds.segments, seg)
+	}
+
+	if err := os.Rename(tmpPath, ds.segmentPath(seg)); err != nil {
+		return err
+	}
+
+	// Only record the new offsets once the rename has landed: a crash
+	// between the rename and these writes just means a restart re-derives
+	// (and re-records) the same offsets next time this segment crosses
+	// the dead-byte threshold, whereas recording them first could point
+	// the on-disk index at a file that a crash left un-renamed.
+	for _, h := range moved {
+		if err := ds.index.writeRecordLocked(h, ds.index.entries[h]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
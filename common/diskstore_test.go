@@ -0,0 +1,235 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"testing"
+
+	"github.com/adityapk00/lightwalletd/walletrpc"
+)
+
+func compactBlockFor(height int) *walletrpc.CompactBlock {
+	return &walletrpc.CompactBlock{
+		Height: uint64(height),
+		Hash:   []byte{byte(height), byte(height >> 8)},
+	}
+}
+
+func TestDiskStorePutGet(t *testing.T) {
+	ds, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for h := 0; h < 5; h++ {
+		if err := ds.Put(h, compactBlockFor(h)); err != nil {
+			t.Fatalf("Put(%d): %v", h, err)
+		}
+	}
+	for h := 0; h < 5; h++ {
+		block, err := ds.Get(h)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", h, err)
+		}
+		if block == nil || block.Height != uint64(h) {
+			t.Fatalf("Get(%d) = %+v, want height %d", h, block, h)
+		}
+	}
+
+	if block, err := ds.Get(100); err != nil || block != nil {
+		t.Fatalf("Get(100) = %+v, %v, want nil, nil", block, err)
+	}
+}
+
+func TestDiskStoreReopenRebuildsTail(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h < 3; h++ {
+		if err := ds.Put(h, compactBlockFor(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ds2, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h < 3; h++ {
+		block, err := ds2.Get(h)
+		if err != nil || block == nil || block.Height != uint64(h) {
+			t.Fatalf("after reopen, Get(%d) = %+v, %v", h, block, err)
+		}
+	}
+}
+
+func TestDiskStoreReorgTruncates(t *testing.T) {
+	ds, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h < 5; h++ {
+		if err := ds.Put(h, compactBlockFor(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ds.Reorg(3); err != nil { // drop heights >= 3
+		t.Fatal(err)
+	}
+
+	for h := 0; h < 3; h++ {
+		if block, err := ds.Get(h); err != nil || block == nil {
+			t.Fatalf("Get(%d) after reorg = %+v, %v, want present", h, block, err)
+		}
+	}
+	for h := 3; h < 5; h++ {
+		if block, err := ds.Get(h); err != nil || block != nil {
+			t.Fatalf("Get(%d) after reorg = %+v, %v, want nil", h, block, err)
+		}
+	}
+}
+
+// TestDiskStoreReopenAfterReorgStaysTruncated guards against a reorg's
+// truncation being in-memory only: without a tombstone written to the
+// on-disk index, reopening the store would rebuild its map straight from
+// the file's original (pre-reorg) records and serve the reorged-away
+// block as if it were still canonical.
+func TestDiskStoreReopenAfterReorgStaysTruncated(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h < 5; h++ {
+		if err := ds.Put(h, compactBlockFor(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Reorg(3); err != nil {
+		t.Fatal(err)
+	}
+
+	ds2, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := 0; h < 3; h++ {
+		if block, err := ds2.Get(h); err != nil || block == nil {
+			t.Fatalf("after reopen, Get(%d) = %+v, %v, want present", h, block, err)
+		}
+	}
+	for h := 3; h < 5; h++ {
+		if block, err := ds2.Get(h); err != nil || block != nil {
+			t.Fatalf("after reopen, Get(%d) = %+v, %v, want nil (reorged away)", h, block, err)
+		}
+	}
+}
+
+// TestDiskStoreReopenAfterCompactReadsNewOffsets guards against compaction
+// rewriting a segment's on-disk offsets in the in-memory index only: a
+// restart that rebuilds the index from the file's original (pre-compact)
+// records would then read stale offsets against the smaller, compacted
+// segment file, returning EOF instead of the block.
+func TestDiskStoreReopenAfterCompactReadsNewOffsets(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill and rotate through a few segments so segment 0 is no longer
+	// the current append target.
+	const perSegment = 3
+	for seg := uint32(0); seg < 3; seg++ {
+		for i := 0; i < perSegment; i++ {
+			h := int(seg)*perSegment + i
+			if err := ds.Put(h, compactBlockFor(h)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ds.openSegmentForAppend(seg + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Drop everything in segment 0 except its last height, so that
+	// height's offset actually moves (down to 0) once compaction
+	// rewrites the segment around it, rather than coincidentally staying
+	// put because it was already first.
+	const survivingHeight = perSegment - 1
+	ds.index.mu.Lock()
+	for h := 0; h < perSegment; h++ {
+		if h != survivingHeight {
+			delete(ds.index.entries, h)
+		}
+	}
+	ds.index.mu.Unlock()
+
+	if err := ds.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	ds2, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ds2.Get(survivingHeight)
+	if err != nil {
+		t.Fatalf("after reopen, Get(%d) = %v, want no error", survivingHeight, err)
+	}
+	if block == nil || block.Height != uint64(survivingHeight) {
+		t.Fatalf("after reopen, Get(%d) = %+v, want height %d", survivingHeight, block, survivingHeight)
+	}
+}
+
+// TestDiskStoreCompactDoesNotCorruptReopenedSegment guards against the
+// stale-fd bug: a segment that was once the append target (and so once
+// cached an *os.File in ds.segments), then rotated away from and
+// compacted, must still read back correctly through Get, which always
+// opens its own fresh fd rather than trusting ds.segments.
+func TestDiskStoreCompactDoesNotCorruptReopenedSegment(t *testing.T) {
+	ds, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill and rotate through a few segments so segment 0 is no longer
+	// the current append target.
+	const perSegment = 3
+	for seg := uint32(0); seg < 3; seg++ {
+		for i := 0; i < perSegment; i++ {
+			h := int(seg)*perSegment + i
+			if err := ds.Put(h, compactBlockFor(h)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ds.openSegmentForAppend(seg + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reorg away everything in segment 0 except height 0, so segment 0's
+	// dead-byte ratio crosses the compaction threshold.
+	ds.index.mu.Lock()
+	for h := 1; h < perSegment; h++ {
+		delete(ds.index.entries, h)
+	}
+	ds.index.mu.Unlock()
+
+	if err := ds.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	block, err := ds.Get(0)
+	if err != nil {
+		t.Fatalf("Get(0) after compaction: %v", err)
+	}
+	if block == nil || block.Height != 0 {
+		t.Fatalf("Get(0) after compaction = %+v, want height 0", block)
+	}
+}
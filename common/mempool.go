@@ -0,0 +1,245 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/adityapk00/lightwalletd/parser"
+	"github.com/adityapk00/lightwalletd/walletrpc"
+	"github.com/pebbe/zmq4"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// mempoolRingSize bounds how many recently-seen txids MempoolMonitor
+// remembers for de-duplication. zcashd's ZMQ rawtx notifier can redeliver
+// a tx (e.g. across a reconnect), and wallets don't want duplicates.
+const mempoolRingSize = 4096
+
+// mempoolClientBuffer is the per-client outgoing queue depth. A client
+// slower than this falls behind and is dropped rather than blocking the
+// monitor's fan-out loop.
+const mempoolClientBuffer = 64
+
+// MempoolMonitor subscribes to zcashd's ZMQ "rawtx" topic and fans out
+// each newly-seen transaction, as a RawTransaction (the same shape
+// GetMempoolStream's gRPC clients expect), to subscribed clients (one per
+// GetMempoolStream call, served by ServeMempoolStream below). It
+// maintains a de-duplicated ring buffer of recent txids so the same tx is
+// never delivered twice to a given subscriber.
+type MempoolMonitor struct {
+	endpoint string
+
+	mu          sync.Mutex
+	subscribers map[chan *walletrpc.RawTransaction]struct{}
+
+	seen     map[string]struct{}
+	seenRing []string
+	seenPos  int
+}
+
+// NewMempoolMonitor returns a MempoolMonitor that will subscribe to
+// zcashd's rawtx notifications at endpoint once Run is called.
+func NewMempoolMonitor(endpoint string) *MempoolMonitor {
+	return &MempoolMonitor{
+		endpoint:    endpoint,
+		subscribers: make(map[chan *walletrpc.RawTransaction]struct{}),
+		seen:        make(map[string]struct{}),
+		seenRing:    make([]string, mempoolRingSize),
+	}
+}
+
+// Subscribe registers a new client and returns a channel of RawTransaction
+// that will receive every mempool transaction observed from here on. The
+// caller must call the returned cancel function when done (e.g. when the
+// gRPC stream's context is cancelled) to free the subscription.
+func (m *MempoolMonitor) Subscribe() (ch <-chan *walletrpc.RawTransaction, cancel func()) {
+	c := make(chan *walletrpc.RawTransaction, mempoolClientBuffer)
+	m.mu.Lock()
+	m.subscribers[c] = struct{}{}
+	m.mu.Unlock()
+	return c, func() {
+		m.mu.Lock()
+		delete(m.subscribers, c)
+		m.mu.Unlock()
+	}
+}
+
+// Run connects to zcashd's ZMQ rawtx topic and fans out parsed
+// transactions until stop is closed. Connection failures are retried with
+// the same backoff schedule as FirstRPC, since a dropped ZMQ connection
+// shouldn't bring down the server.
+func (m *MempoolMonitor) Run(stop <-chan struct{}) {
+	retryCount := 0
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		sub, err := m.connect()
+		if err != nil {
+			retryCount++
+			Log.WithFields(logrus.Fields{
+				"error": err,
+				"retry": retryCount,
+			}).Warn("mempool: error connecting to zcashd ZMQ, retrying...")
+			Time.Sleep(time.Duration(10+retryCount*5) * time.Second) // backoff
+			continue
+		}
+		retryCount = 0
+		m.readLoop(sub, stop)
+		sub.Close()
+	}
+}
+
+func (m *MempoolMonitor) connect() (*zmq4.Socket, error) {
+	sub, err := zmq4.NewSocket(zmq4.SUB)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating zmq socket")
+	}
+	if err := sub.Connect(m.endpoint); err != nil {
+		sub.Close()
+		return nil, errors.Wrap(err, "connecting to zmq endpoint")
+	}
+	if err := sub.SetSubscribe("rawtx"); err != nil {
+		sub.Close()
+		return nil, errors.Wrap(err, "subscribing to rawtx")
+	}
+	return sub, nil
+}
+
+func (m *MempoolMonitor) readLoop(sub *zmq4.Socket, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		msg, err := sub.RecvMessageBytes(0)
+		if err != nil {
+			Log.WithFields(logrus.Fields{"error": err}).Warn("mempool: zmq recv failed, reconnecting")
+			return
+		}
+		if len(msg) < 2 {
+			continue
+		}
+		m.handleRawTx(msg[1])
+	}
+}
+
+func (m *MempoolMonitor) handleRawTx(raw []byte) {
+	tx := parser.NewTransaction()
+	rest, err := tx.ParseFromSlice(raw)
+	if err != nil {
+		Log.WithFields(logrus.Fields{"error": err}).Warn("mempool: error parsing raw tx")
+		return
+	}
+	if len(rest) != 0 {
+		Log.Warn("mempool: received overlong raw tx message")
+		return
+	}
+	txid := hex.EncodeToString(tx.GetDisplayHash())
+	if m.markSeen(txid) {
+		return // already delivered this tx
+	}
+	// Height 0 signals "not yet mined": this tx was just seen on zcashd's
+	// rawtx ZMQ topic, so it has no confirmation height yet.
+	m.broadcast(&walletrpc.RawTransaction{Data: raw, Height: 0})
+}
+
+// markSeen records txid in the ring buffer and returns true if it was
+// already present (i.e. this tx should not be redelivered).
+func (m *MempoolMonitor) markSeen(txid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.seen[txid]; ok {
+		return true
+	}
+	if evicted := m.seenRing[m.seenPos]; evicted != "" {
+		delete(m.seen, evicted)
+	}
+	m.seenRing[m.seenPos] = txid
+	m.seenPos = (m.seenPos + 1) % mempoolRingSize
+	m.seen[txid] = struct{}{}
+	return false
+}
+
+// broadcast delivers tx to every subscriber, dropping (not blocking on)
+// any client whose buffer is already full.
+func (m *MempoolMonitor) broadcast(tx *walletrpc.RawTransaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c := range m.subscribers {
+		select {
+		case c <- tx:
+		default:
+			Log.Warn("mempool: subscriber buffer full, dropping tx for slow client")
+		}
+	}
+}
+
+// mempoolMonitor is the package-level monitor started by
+// StartMempoolMonitor from Options.ZMQEndpoint, mirroring the
+// zmqEndpoint/diskStore package-variable pattern. ServeMempoolStream reads
+// it to find the monitor to subscribe to.
+var mempoolMonitor *MempoolMonitor
+
+// mempoolStopChan is closed by StopMempoolMonitor to shut down Run. It's
+// closed rather than sent-to (compare stopIngestorChan, which has exactly
+// one reader) since it only ever needs one signal delivered to one reader.
+var mempoolStopChan = make(chan struct{})
+
+// StartMempoolMonitor creates a MempoolMonitor for endpoint, starts its
+// Run loop in a goroutine (stopped by StopMempoolMonitor), installs it as
+// the package-level mempoolMonitor, and returns it. Called once at
+// startup, alongside startIngestor, from Options.ZMQEndpoint.
+func StartMempoolMonitor(endpoint string) *MempoolMonitor {
+	m := NewMempoolMonitor(endpoint)
+	mempoolMonitor = m
+	go m.Run(mempoolStopChan)
+	return m
+}
+
+// StopMempoolMonitor shuts down the monitor started by StartMempoolMonitor.
+// Safe to call even if StartMempoolMonitor was never called.
+func StopMempoolMonitor() {
+	select {
+	case <-mempoolStopChan:
+		// already stopped
+	default:
+		close(mempoolStopChan)
+	}
+}
+
+// ServeMempoolStream is the GetMempoolStream RPC handler: it subscribes to
+// the running mempool monitor and forwards every RawTransaction to stream
+// until the stream's context is cancelled or the monitor itself shuts down.
+func ServeMempoolStream(_ *walletrpc.Empty, stream walletrpc.CompactTxStreamer_GetMempoolStreamServer) error {
+	if mempoolMonitor == nil {
+		return errors.New("mempool streaming is not enabled (no ZMQEndpoint configured)")
+	}
+	ch, cancel := mempoolMonitor.Subscribe()
+	defer cancel()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case tx, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(tx); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/adityapk00/lightwalletd/walletrpc"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	// mempool_test.go is the first in this package to exercise a logged
+	// code path (the drop-slow-client branch of broadcast); Log is
+	// otherwise nil until the server sets it up in main().
+	if Log == nil {
+		Log = logrus.New().WithField("app", "test")
+	}
+}
+
+func TestMempoolMonitorMarkSeenDedups(t *testing.T) {
+	m := NewMempoolMonitor("")
+
+	if seen := m.markSeen("abc"); seen {
+		t.Fatal("first sighting of a txid should not be reported as already seen")
+	}
+	if seen := m.markSeen("abc"); !seen {
+		t.Fatal("second sighting of the same txid should be reported as already seen")
+	}
+	if seen := m.markSeen("def"); seen {
+		t.Fatal("a different txid should not be reported as already seen")
+	}
+}
+
+func TestMempoolMonitorMarkSeenRingEviction(t *testing.T) {
+	m := NewMempoolMonitor("")
+
+	m.markSeen("abc")
+	// Fill the ring exactly once more so "abc" (the first entry) is evicted.
+	for i := 0; i < mempoolRingSize; i++ {
+		m.markSeen("filler-" + strconv.Itoa(i))
+	}
+	if seen := m.markSeen("abc"); seen {
+		t.Fatal("markSeen on a previously-seen-but-since-evicted txid should not report seen")
+	}
+}
+
+func TestMempoolMonitorBroadcastDropsSlowClient(t *testing.T) {
+	m := NewMempoolMonitor("")
+	ch, cancel := m.Subscribe()
+	defer cancel()
+
+	tx := &walletrpc.RawTransaction{Data: []byte{1}}
+	for i := 0; i < mempoolClientBuffer; i++ {
+		m.broadcast(tx)
+	}
+	// The buffer is now full; broadcast must drop rather than block.
+	m.broadcast(tx)
+
+	if len(ch) != mempoolClientBuffer {
+		t.Fatalf("expected the subscriber channel to stay at capacity %d, got %d", mempoolClientBuffer, len(ch))
+	}
+}
+
+func TestMempoolMonitorBroadcastDeliversToSubscriber(t *testing.T) {
+	m := NewMempoolMonitor("")
+	ch, cancel := m.Subscribe()
+	defer cancel()
+
+	tx := &walletrpc.RawTransaction{Data: []byte{9, 9}}
+	m.broadcast(tx)
+
+	select {
+	case got := <-ch:
+		if string(got.Data) != string(tx.Data) {
+			t.Fatalf("got tx data %x, want %x", got.Data, tx.Data)
+		}
+	default:
+		t.Fatal("expected broadcast tx to be available on the subscriber channel")
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// PrometheusMetrics holds the counters/gauges lightwalletd exposes on its
+// /metrics endpoint. A single instance is created at startup and assigned
+// to the package-level Metrics variable.
+type PrometheusMetrics struct {
+	// cacheHitCounter counts DiskStore.Get calls served from the mmap
+	// index without a disk read (currently folded into cacheDiskHitCounter
+	// since every present entry requires one pread; kept separate so a
+	// future in-memory layer has somewhere to report to).
+	cacheHitCounter prometheus.Counter
+
+	// cacheDiskHitCounter counts blocks served from the on-disk segment
+	// store (BlockCache -> DiskStore.Get succeeded).
+	cacheDiskHitCounter prometheus.Counter
+
+	// cacheFallbackCounter counts blocks that weren't in the disk store
+	// and required a zcashd RPC round-trip.
+	cacheFallbackCounter prometheus.Counter
+}
+
+// NewPrometheusMetrics creates, registers, and returns the lightwalletd
+// metrics set. MustRegister panics on a duplicate registration, so this
+// must only be called once per process (at startup, assigning the result
+// to the package-level Metrics variable).
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		cacheHitCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lightwalletd_cache_hits_total",
+			Help: "Number of GetBlock calls served from the in-process cache",
+		}),
+		cacheDiskHitCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lightwalletd_cache_disk_hits_total",
+			Help: "Number of GetBlock calls served from the on-disk block store",
+		}),
+		cacheFallbackCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lightwalletd_cache_rpc_fallbacks_total",
+			Help: "Number of GetBlock calls that required a zcashd RPC round-trip",
+		}),
+	}
+	prometheus.MustRegister(m.cacheHitCounter, m.cacheDiskHitCounter, m.cacheFallbackCounter)
+	return m
+}
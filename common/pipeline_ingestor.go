@@ -0,0 +1,139 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"sync"
+
+	"github.com/adityapk00/lightwalletd/walletrpc"
+)
+
+// defaultIngestConcurrency and defaultIngestBatch are used when
+// Options.IngestConcurrency / Options.IngestBatch are left at zero.
+const (
+	defaultIngestConcurrency = 8
+	defaultIngestBatch       = 64
+)
+
+var (
+	ingestConcurrency = defaultIngestConcurrency
+	ingestBatch       = defaultIngestBatch
+)
+
+// SetIngestOptions configures the worker-pool size and batch depth used by
+// the pipelined initial-sync fetcher, from Options.IngestConcurrency and
+// Options.IngestBatch. A zero value keeps the corresponding default.
+func SetIngestOptions(concurrency, batch int) {
+	if concurrency > 0 {
+		ingestConcurrency = concurrency
+	}
+	if batch > 0 {
+		ingestBatch = batch
+	}
+}
+
+// pipelineCache is the subset of *BlockCache's methods pipelineCatchUp
+// needs. It exists so tests can drive pipelineCatchUp (in particular its
+// reorg-restart branch) against a fake cache, the same way fetchBatch is
+// tested against a fakeBlockSource, without needing a real *BlockCache.
+// BlockIngestor passes a *BlockCache here, which satisfies this interface
+// structurally.
+type pipelineCache interface {
+	GetNextHeight() int
+	GetFirstHeight() int
+	GetLatestHash() []byte
+	HashMatch(prevHash []byte) bool
+	Reorg(height int)
+	Add(height int, block *walletrpc.CompactBlock) error
+}
+
+// pipelineCatchUp fetches blocks starting at c.GetNextHeight() using a
+// bounded worker pool instead of one RPC at a time, since during initial
+// sync the RPC round-trip (not local CPU) dominates and blocks can be
+// requested for many heights concurrently. Results are committed to the
+// cache strictly in height order through a reorder buffer, preserving the
+// same reorg semantics as the sequential path: c.HashMatch is checked
+// before c.Add, and a mismatch drains the in-flight batch and restarts
+// from the new post-reorg height.
+//
+// It returns once a requested height comes back with no block (i.e. we've
+// caught up to the chain tip), handing off to the steady-state,
+// push-aware single-block loop in ingestFromSource.
+func pipelineCatchUp(c pipelineCache, source BlockSource) {
+	for {
+		start := c.GetNextHeight()
+		blocks, caughtUp := fetchBatch(source, start, ingestBatch, ingestConcurrency)
+
+		restart := false
+		for i, block := range blocks {
+			height := start + i
+			if block == nil {
+				return // reached the tip; hand off to steady-state ingestion
+			}
+			if !c.HashMatch(block.PrevHash) {
+				if height == c.GetFirstHeight() {
+					return // can't reorg before the first block; let caller wait
+				}
+				Log.Info("REORG (pipeline): dropping block ", height-1, " ", displayHash(c.GetLatestHash()))
+				c.Reorg(height - 1)
+				persistReorg(height - 1)
+				restart = true
+				break
+			}
+			if err := c.Add(height, block); err != nil {
+				Log.Fatal("Cache add failed:", err)
+			}
+			persistIngested(height, block)
+		}
+		if restart {
+			continue // remaining in-flight results for this batch are simply discarded
+		}
+		if caughtUp {
+			return
+		}
+	}
+}
+
+// fetchBatch requests heights [start, start+n) from source using up to
+// concurrency workers, and returns the results in height order (nil entry
+// for a height zcashd doesn't have yet). caughtUp is true if any height in
+// the batch came back nil, meaning the caller should stop pipelining
+// further batches.
+func fetchBatch(source BlockSource, start, n, concurrency int) (blocks []*walletrpc.CompactBlock, caughtUp bool) {
+	blocks = make([]*walletrpc.CompactBlock, n)
+	errs := make([]error, n)
+
+	jobs := make(chan int, n)
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				block, err := source.GetBlock(start + i)
+				blocks[i] = block
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Truncate the batch at the first error or missing block, so the
+	// caller never commits past a gap out of height order.
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			Log.Fatal("getblock failed, will retry", errs[i])
+		}
+		if blocks[i] == nil {
+			return blocks[:i+1], true
+		}
+	}
+	return blocks, false
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adityapk00/lightwalletd/walletrpc"
+)
+
+// fakeBlockSource serves a fixed, in-memory chain of blocks, simulating
+// zcashd's RPC behavior of returning nil once a requested height is past
+// the known tip. It lets tests drive fetchBatch/pipelineCatchUp without
+// the real RawRequest plumbing.
+type fakeBlockSource struct {
+	blocks map[int]*walletrpc.CompactBlock
+}
+
+func (f *fakeBlockSource) BestBlockHash() ([]byte, error) { return nil, nil }
+
+func (f *fakeBlockSource) GetBlock(height int) (*walletrpc.CompactBlock, error) {
+	return f.blocks[height], nil
+}
+
+func (f *fakeBlockSource) Subscribe(ctx context.Context) <-chan BlockEvent { return nil }
+
+func makeFakeChain(n int) *fakeBlockSource {
+	blocks := make(map[int]*walletrpc.CompactBlock, n)
+	for h := 0; h < n; h++ {
+		hash := []byte{byte(h)}
+		prevHash := []byte{}
+		if h > 0 {
+			prevHash = []byte{byte(h - 1)}
+		}
+		blocks[h] = &walletrpc.CompactBlock{Height: uint64(h), Hash: hash, PrevHash: prevHash}
+	}
+	return &fakeBlockSource{blocks: blocks}
+}
+
+func TestFetchBatchStopsAtTip(t *testing.T) {
+	source := makeFakeChain(10)
+
+	blocks, caughtUp := fetchBatch(source, 0, 20, 4)
+	if !caughtUp {
+		t.Fatal("expected fetchBatch to report caught up once past the known tip")
+	}
+	if len(blocks) != 11 {
+		t.Fatalf("expected 10 real blocks plus the trailing nil sentinel, got %d", len(blocks))
+	}
+	for h := 0; h < 10; h++ {
+		if blocks[h] == nil || blocks[h].Height != uint64(h) {
+			t.Fatalf("block at height %d missing or wrong: %+v", h, blocks[h])
+		}
+	}
+	if blocks[10] != nil {
+		t.Fatalf("expected nil sentinel at the tip, got %+v", blocks[10])
+	}
+}
+
+// fakeCache is a minimal pipelineCache implementation letting tests drive
+// pipelineCatchUp's reorg-restart branch without a real *BlockCache.
+type fakeCache struct {
+	blocks      map[int]*walletrpc.CompactBlock // height -> committed block
+	firstHeight int
+	nextHeight  int
+	reorgedTo   []int // heights passed to Reorg, in call order
+}
+
+func newFakeCache(firstHeight int) *fakeCache {
+	return &fakeCache{blocks: make(map[int]*walletrpc.CompactBlock), firstHeight: firstHeight, nextHeight: firstHeight}
+}
+
+func (c *fakeCache) GetNextHeight() int  { return c.nextHeight }
+func (c *fakeCache) GetFirstHeight() int { return c.firstHeight }
+
+func (c *fakeCache) GetLatestHash() []byte {
+	if block := c.blocks[c.nextHeight-1]; block != nil {
+		return block.Hash
+	}
+	return nil
+}
+
+func (c *fakeCache) HashMatch(prevHash []byte) bool {
+	if c.nextHeight == c.firstHeight {
+		return true // no prior block to match against yet
+	}
+	return string(c.GetLatestHash()) == string(prevHash)
+}
+
+// Reorg drops block height and everything after it, matching the
+// "dropping block height" semantics pipelineCatchUp logs before calling it.
+func (c *fakeCache) Reorg(height int) {
+	c.reorgedTo = append(c.reorgedTo, height)
+	for h := range c.blocks {
+		if h >= height {
+			delete(c.blocks, h)
+		}
+	}
+	c.nextHeight = height
+}
+
+func (c *fakeCache) Add(height int, block *walletrpc.CompactBlock) error {
+	c.blocks[height] = block
+	c.nextHeight = height + 1
+	return nil
+}
+
+// reorgingBlockSource behaves like fakeBlockSource, except that from
+// forkHeight-1 onward it always serves an alternate ("0xf0-tagged") chain
+// instead of the original one. Its block at forkHeight-1 keeps the
+// original chain's hash as its own PrevHash (the fork's common ancestor is
+// forkHeight-2), so the very first time pipelineCatchUp fetches forkHeight
+// it finds a PrevHash that doesn't match what's already committed to the
+// cache at forkHeight-1 from the original chain — simulating a reorg
+// discovered mid-batch. GetBlock's answer depends only on height, not on
+// call history, so it's safe to call concurrently from fetchBatch's
+// worker pool.
+type reorgingBlockSource struct {
+	*fakeBlockSource
+	forkHeight int
+}
+
+func (f *reorgingBlockSource) GetBlock(height int) (*walletrpc.CompactBlock, error) {
+	if height < f.forkHeight-1 || height >= len(f.fakeBlockSource.blocks) {
+		return f.fakeBlockSource.GetBlock(height)
+	}
+	hash := []byte{byte(height), 0xf0}
+	prevHash := []byte{byte(height - 1), 0xf0}
+	if height == f.forkHeight-1 {
+		// The fork's root still descends from the original chain's
+		// unchanged ancestor.
+		prevHash = []byte{byte(height - 1)}
+	}
+	return &walletrpc.CompactBlock{Height: uint64(height), Hash: hash, PrevHash: prevHash}, nil
+}
+
+func TestPipelineCatchUpRestartsAfterReorg(t *testing.T) {
+	const chainLen = 10
+	const forkHeight = 5
+
+	source := &reorgingBlockSource{fakeBlockSource: makeFakeChain(chainLen), forkHeight: forkHeight}
+
+	cache := newFakeCache(0)
+	// Seed the cache with the pre-fork chain up to forkHeight-1, as if a
+	// prior batch had already committed them.
+	for h := 0; h < forkHeight; h++ {
+		block, _ := source.fakeBlockSource.GetBlock(h)
+		if err := cache.Add(h, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pipelineCatchUp(cache, source)
+
+	if len(cache.reorgedTo) != 1 || cache.reorgedTo[0] != forkHeight-1 {
+		t.Fatalf("expected exactly one Reorg(%d), got %+v", forkHeight-1, cache.reorgedTo)
+	}
+	for h := forkHeight; h < chainLen; h++ {
+		block := cache.blocks[h]
+		if block == nil || block.Hash[1] != 0xf0 {
+			t.Fatalf("height %d: expected to be committed from the post-reorg fork, got %+v", h, block)
+		}
+	}
+}
+
+func TestFetchBatchWithinChain(t *testing.T) {
+	source := makeFakeChain(10)
+
+	blocks, caughtUp := fetchBatch(source, 2, 3, 2)
+	if caughtUp {
+		t.Fatal("did not expect caughtUp when the whole batch is within the known chain")
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %d", len(blocks))
+	}
+	for i, block := range blocks {
+		height := 2 + i
+		if block == nil || block.Height != uint64(height) {
+			t.Fatalf("block at index %d: expected height %d, got %+v", i, height, block)
+		}
+	}
+}
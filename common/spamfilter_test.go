@@ -0,0 +1,239 @@
+// Copyright (c) 2019-2020 The Zcash developers
+// Distributed under the MIT software license, see the accompanying
+// file COPYING or https://www.opensource.org/licenses/mit-license.php .
+
+package common
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adityapk00/lightwalletd/walletrpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func ruleWithCounter(name string, rule SpamRule) SpamRule {
+	rule.Name = name
+	rule.hitCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "lightwalletd_spamfilter_rule_hits_total_test_" + name,
+		Help:        "test counter",
+		ConstLabels: prometheus.Labels{"policy": "p", "rule": name},
+	})
+	return rule
+}
+
+func TestFirstMatchOutputThreshold(t *testing.T) {
+	policy := &SpamPolicy{Rules: []SpamRule{
+		ruleWithCounter("outputs", SpamRule{OutputThreshold: 2, Action: RedactStripSapling}),
+	}}
+	tx := &walletrpc.CompactTx{Outputs: []*walletrpc.CompactSaplingOutput{{}, {}, {}}}
+
+	if rule := firstMatch(policy, tx); rule == nil || rule.Name != "outputs" {
+		t.Fatalf("expected the outputs rule to match, got %+v", rule)
+	}
+}
+
+func TestFirstMatchActionThreshold(t *testing.T) {
+	policy := &SpamPolicy{Rules: []SpamRule{
+		ruleWithCounter("actions", SpamRule{ActionThreshold: 1, Action: RedactStripOrchard}),
+	}}
+	tx := &walletrpc.CompactTx{Actions: []*walletrpc.CompactOrchardAction{{}, {}}}
+
+	if rule := firstMatch(policy, tx); rule == nil || rule.Name != "actions" {
+		t.Fatalf("expected the actions rule to match, got %+v", rule)
+	}
+}
+
+func TestFirstMatchNoteThreshold(t *testing.T) {
+	policy := &SpamPolicy{Rules: []SpamRule{
+		ruleWithCounter("notes", SpamRule{NoteThreshold: 2, Action: RedactDrop}),
+	}}
+	tx := &walletrpc.CompactTx{
+		Outputs: []*walletrpc.CompactSaplingOutput{{}, {}},
+		Actions: []*walletrpc.CompactOrchardAction{{}},
+	}
+
+	if rule := firstMatch(policy, tx); rule == nil || rule.Name != "notes" {
+		t.Fatalf("expected the notes rule to match on combined output+action count, got %+v", rule)
+	}
+}
+
+func TestFirstMatchNoRuleMatches(t *testing.T) {
+	policy := &SpamPolicy{Rules: []SpamRule{
+		ruleWithCounter("outputs", SpamRule{OutputThreshold: 10, Action: RedactStripSapling}),
+	}}
+	tx := &walletrpc.CompactTx{Outputs: []*walletrpc.CompactSaplingOutput{{}}}
+
+	if rule := firstMatch(policy, tx); rule != nil {
+		t.Fatalf("expected no rule to match, got %+v", rule)
+	}
+}
+
+func TestFirstMatchDenylist(t *testing.T) {
+	txid := "abad1dea00000000000000000000000000000000000000000000000000000000000000000000"[:64]
+	policy := &SpamPolicy{Rules: []SpamRule{
+		ruleWithCounter("denylist", SpamRule{Action: RedactDrop}),
+	}}
+	policy.Rules[0].denylistTxids = map[string]bool{txid: true}
+
+	hash := reversedHashFor(t, txid)
+	tx := &walletrpc.CompactTx{Hash: hash}
+
+	if rule := firstMatch(policy, tx); rule == nil || rule.Name != "denylist" {
+		t.Fatalf("expected the denylist rule to match, got %+v", rule)
+	}
+}
+
+// reversedHashFor builds a CompactTx.Hash such that hashToTxid(hash) equals
+// txid, mirroring the byte-reversal displayHash applies via parser.Reverse.
+func reversedHashFor(t *testing.T, txid string) []byte {
+	t.Helper()
+	raw, err := hex.DecodeString(txid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := 0, len(raw)-1; i < j; i, j = i+1, j-1 {
+		raw[i], raw[j] = raw[j], raw[i]
+	}
+	return raw
+}
+
+func TestRedactStripSapling(t *testing.T) {
+	tx := &walletrpc.CompactTx{Outputs: []*walletrpc.CompactSaplingOutput{{Epk: []byte{1}, Ciphertext: []byte{2}}}}
+	redact(tx, RedactStripSapling)
+	if tx.Outputs[0].Epk != nil || tx.Outputs[0].Ciphertext != nil {
+		t.Fatalf("expected sapling output to be stripped, got %+v", tx.Outputs[0])
+	}
+}
+
+func TestRedactStripOrchard(t *testing.T) {
+	tx := &walletrpc.CompactTx{Actions: []*walletrpc.CompactOrchardAction{{EphemeralKey: []byte{1}, Ciphertext: []byte{2}, Nullifier: []byte{3}}}}
+	redact(tx, RedactStripOrchard)
+	a := tx.Actions[0]
+	if a.EphemeralKey != nil || a.Ciphertext != nil || a.Nullifier != nil {
+		t.Fatalf("expected orchard action to be stripped, got %+v", a)
+	}
+}
+
+func TestApplyDropsMatchingTx(t *testing.T) {
+	sf := &SpamFilter{
+		policies: map[string]*SpamPolicy{
+			"strict": {Name: "strict", Rules: []SpamRule{
+				ruleWithCounter("drop-big", SpamRule{OutputThreshold: 1, Action: RedactDrop}),
+			}},
+		},
+		thresholdToName: map[int]string{7: "strict"},
+	}
+	block := &walletrpc.CompactBlock{Vtx: []*walletrpc.CompactTx{
+		{Outputs: []*walletrpc.CompactSaplingOutput{{}, {}}},
+		{Outputs: []*walletrpc.CompactSaplingOutput{{}}},
+	}}
+
+	out := sf.Apply(block, 7)
+	if len(out.Vtx) != 1 {
+		t.Fatalf("expected the spammy tx to be dropped, got %d txs", len(out.Vtx))
+	}
+}
+
+func TestApplyFallsBackToLegacyHeuristic(t *testing.T) {
+	sf := &SpamFilter{policies: map[string]*SpamPolicy{}, thresholdToName: map[int]string{}}
+	block := &walletrpc.CompactBlock{Vtx: []*walletrpc.CompactTx{
+		{Outputs: []*walletrpc.CompactSaplingOutput{{Epk: []byte{1}}, {Epk: []byte{1}}, {Epk: []byte{1}}}},
+	}}
+
+	out := sf.Apply(block, 2)
+	if out.Vtx[0].Outputs[0].Epk != nil {
+		t.Fatal("expected the legacy heuristic to strip outputs when no policy is mapped to the threshold")
+	}
+}
+
+func TestResolveDenylistTxidPassthrough(t *testing.T) {
+	txid := "abcdefabcdefabcdefabcdefabcdefabcdefabcdefabcdefabcdefabcdefabcd"[:64]
+	rule := &SpamRule{Denylist: []string{txid}}
+	if err := resolveDenylist(rule); err != nil {
+		t.Fatal(err)
+	}
+	if !rule.denylistTxids[txid] {
+		t.Fatalf("expected txid-shaped denylist entry to pass through unresolved")
+	}
+}
+
+func TestResolveDenylistResolvesAddressViaRPC(t *testing.T) {
+	orig := RawRequest
+	defer func() { RawRequest = orig }()
+
+	addr := "t1aValidLookingAddressXXXXXXXXXXX"
+	resolvedTxid := "11112222333344445555666677778888999900001111222233334444555566"
+	RawRequest = func(method string, params []json.RawMessage) (json.RawMessage, error) {
+		if method != "getaddresstxids" {
+			t.Fatalf("unexpected RPC method %q", method)
+		}
+		var req ZcashdRpcRequestGetaddresstxids
+		if err := json.Unmarshal(params[0], &req); err != nil {
+			t.Fatal(err)
+		}
+		if len(req.Addresses) != 1 || req.Addresses[0] != addr {
+			t.Fatalf("unexpected addresses %+v", req.Addresses)
+		}
+		return json.Marshal([]string{resolvedTxid})
+	}
+
+	rule := &SpamRule{Denylist: []string{addr}}
+	if err := resolveDenylist(rule); err != nil {
+		t.Fatal(err)
+	}
+	if !rule.denylistTxids[resolvedTxid] {
+		t.Fatalf("expected address to resolve to txid %q via getaddresstxids, got %+v", resolvedTxid, rule.denylistTxids)
+	}
+}
+
+func TestLoadSpamFilterConfigRegistersRuleCounters(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.json")
+	cfg := `{
+		"policies": [{
+			"name": "default",
+			"rules": [{"name": "unique-rule-for-load-test", "output_threshold": 5, "action": "strip_sapling"}]
+		}],
+		"threshold_policy": {"10": "default"}
+	}`
+	if err := os.WriteFile(path, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sf, err := LoadSpamFilterConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, ok := sf.policies["default"]
+	if !ok || len(policy.Rules) != 1 {
+		t.Fatalf("expected one rule in the default policy, got %+v", policy)
+	}
+	if policy.Rules[0].hitCounter == nil {
+		t.Fatal("expected the rule's hitCounter to be populated by LoadSpamFilterConfig")
+	}
+	if sf.thresholdToName[10] != "default" {
+		t.Fatalf("expected threshold 10 to map to policy \"default\", got %q", sf.thresholdToName[10])
+	}
+}
+
+func TestLoadSpamFilterConfigRejectsUnsupportedAction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.json")
+	cfg := `{
+		"policies": [{
+			"name": "default",
+			"rules": [{"name": "bad-rule", "output_threshold": 5, "action": "flag"}]
+		}]
+	}`
+	if err := os.WriteFile(path, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadSpamFilterConfig(path); err == nil {
+		t.Fatal("expected LoadSpamFilterConfig to reject a rule with an unsupported action")
+	}
+}